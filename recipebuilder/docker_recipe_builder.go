@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 
@@ -20,6 +21,46 @@ const (
 	DockerIndexServer = "docker.io"
 )
 
+const (
+	DockerLoginServerEnvVar   = "DOCKER_LOGIN_SERVER"
+	DockerUserEnvVar          = "DOCKER_USER"
+	DockerPasswordEnvVar      = "DOCKER_PASSWORD"
+	DockerEmailEnvVar         = "DOCKER_EMAIL"
+	DockerRegistryTokenEnvVar = "DOCKER_REGISTRY_TOKEN"
+)
+
+// ErrDockerCredentialsIncomplete is returned when only one of DockerUser or
+// DockerPassword is set on the CC request; a registry login requires both.
+var ErrDockerCredentialsIncomplete = errors.New("docker user and password must both be set, or both be empty")
+
+// ErrDockerImageLoginServerMismatch is returned when DockerLoginServer is
+// set but is not actually a prefix of DockerImageUrl, which would otherwise
+// silently no-op the prefix strip and produce a garbled RootFs referencing
+// the wrong registry host.
+var ErrDockerImageLoginServerMismatch = errors.New("docker image url is not hosted on the supplied docker login server")
+
+// ErrInvalidDockerDigest is returned when a pinned "@algo:hex" digest does
+// not match a recognized algorithm and hex-encoded length, e.g. a truncated
+// or otherwise malformed digest that would silently fail content-address
+// verification later in the RootFs fetcher instead of at recipe-build time.
+var ErrInvalidDockerDigest = errors.New("docker image digest is not a valid algo:hex reference")
+
+// DefaultHealthCheckTimeout bounds how long an image's HEALTHCHECK Test is
+// given to run when the image itself does not declare a Timeout.
+const DefaultHealthCheckTimeout = 30 * time.Second
+
+// HealthLogSource tags log lines emitted by an image-provided HEALTHCHECK,
+// distinguishing them from the app's own stdout/stderr.
+const HealthLogSource = "HEALTH"
+
+// ErrNoHealthCheckDefined and ErrInvalidHealthCheck surface a malformed or
+// empty image HEALTHCHECK Test so it fails fast at recipe-build time rather
+// than at container runtime.
+var (
+	ErrNoHealthCheckDefined = errors.New("image healthcheck has no Test defined")
+	ErrInvalidHealthCheck   = errors.New("image healthcheck Test must be a CMD or CMD-SHELL array")
+)
+
 type DockerRecipeBuilder struct {
 	logger lager.Logger
 	config Config
@@ -38,12 +79,12 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 	buildLogger := b.logger.Session("message-builder")
 
 	if desiredApp.DockerImageUrl == "" {
-		buildLogger.Error("desired-app-invalid", ErrDockerImageMissing, lager.Data{"desired-app": desiredApp})
+		buildLogger.Error("desired-app-invalid", ErrDockerImageMissing, lager.Data{"desired-app": redactDockerCredentials(desiredApp)})
 		return nil, ErrDockerImageMissing
 	}
 
 	if desiredApp.DropletUri != "" && desiredApp.DockerImageUrl != "" {
-		buildLogger.Error("desired-app-invalid", ErrMultipleAppSources, lager.Data{"desired-app": desiredApp})
+		buildLogger.Error("desired-app-invalid", ErrMultipleAppSources, lager.Data{"desired-app": redactDockerCredentials(desiredApp)})
 		return nil, ErrMultipleAppSources
 	}
 
@@ -63,15 +104,21 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 
 	lifecycleURL := lifecycleDownloadURL(lifecyclePath, b.config.FileServerURL)
 
+	if (desiredApp.DockerUser == "") != (desiredApp.DockerPassword == "") {
+		buildLogger.Error("desired-app-invalid", ErrDockerCredentialsIncomplete, lager.Data{"desired-app": redactDockerCredentials(desiredApp)})
+		return nil, ErrDockerCredentialsIncomplete
+	}
+
 	rootFSPath := ""
 	var err error
-	rootFSPath, err = convertDockerURI(desiredApp.DockerImageUrl)
+	rootFSPath, err = convertDockerURI(desiredApp.DockerImageUrl, desiredApp.DockerLoginServer)
 	if err != nil {
+		buildLogger.Error("desired-app-invalid", err, lager.Data{"desired-app": redactDockerCredentials(desiredApp)})
 		return nil, err
 	}
 
 	var privilegedContainer bool
-	var containerEnvVars []*models.EnvironmentVariable
+	containerEnvVars := dockerCredentialEnvVars(desiredApp)
 
 	numFiles := DefaultFileDescriptorLimit
 	if desiredApp.FileDescriptors != 0 {
@@ -102,14 +149,56 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 		User:     user,
 	})
 
-	desiredAppPorts, err := extractExposedPorts(executionMetadata, b.logger)
+	desiredAppPorts, desiredAppPortMappings, err := extractExposedPorts(executionMetadata, desiredApp.Ports, b.logger)
 	if err != nil {
 		return nil, err
 	}
 
 	switch desiredApp.HealthCheckType {
+	case cc_messages.DockerHealthCheckType:
+		monitor, err = dockerHealthCheckMonitor(executionMetadata, user)
+		if err != nil {
+			buildLogger.Error("invalid-image-healthcheck", err, lager.Data{"desired-app-metadata": executionMetadata})
+			return nil, err
+		}
 	case cc_messages.PortHealthCheckType, cc_messages.UnspecifiedHealthCheckType:
-		monitor = models.Timeout(getParallelAction(desiredAppPorts, user), 30*time.Second)
+		if hasImageHealthcheck(executionMetadata) {
+			monitor, err = dockerHealthCheckMonitor(executionMetadata, user)
+			if err != nil {
+				buildLogger.Error("invalid-image-healthcheck", err, lager.Data{"desired-app-metadata": executionMetadata})
+				return nil, err
+			}
+		} else if len(desiredAppPorts) > 0 {
+			// Probe every exposed TCP port, not just the first. UDP ports
+			// have no analogous "is it open" liveness probe, so they are
+			// exposed (see PortMappings below) but not monitored here.
+			monitor = models.Timeout(getParallelAction(desiredAppPorts, user), 30*time.Second)
+		} else if hasUDPPortMapping(desiredAppPortMappings) {
+			// UDP-only image: a connectionless "is it open" dial can't
+			// attest liveness the way a TCP probe can, so this is a
+			// deliberate decision to run without a Monitor action rather
+			// than a silent fallthrough. Diego still considers the
+			// instance up once Setup/Action complete.
+			buildLogger.Info("no-liveness-monitor-for-udp-only-image", lager.Data{"desired-app-metadata": executionMetadata})
+		}
+	}
+
+	var primaryPort uint32
+	if len(desiredAppPorts) > 0 {
+		primaryPort = desiredAppPorts[0]
+	}
+	// else: only UDP ports remain (the image exposes only UDP ports, or the
+	// request's port whitelist kept only UDP ones), so there is no TCP port to
+	// advertise as PORT; primaryPort is left at its zero value on purpose,
+	// mirroring the lack of a liveness monitor above for the same reason.
+
+	startCommand := desiredApp.StartCommand
+	if startCommand == "" && len(executionMetadata.Entrypoint) > 0 {
+		// The image relies solely on its ENTRYPOINT; cf push --docker-image
+		// never supplied a start command, so fall back to it. The launcher
+		// re-splits startCommand through a shell, so each element must be
+		// quoted individually to preserve argv boundaries.
+		startCommand = shellQuoteJoin(executionMetadata.Entrypoint)
 	}
 
 	actions = append(actions, &models.RunAction{
@@ -117,10 +206,11 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 		Path: "/tmp/lifecycle/launcher",
 		Args: append(
 			[]string{"app"},
-			desiredApp.StartCommand,
+			startCommand,
 			desiredApp.ExecutionMetadata,
 		),
-		Env:       createLrpEnv(desiredApp.Environment, desiredAppPorts[0]),
+		Dir:       executionMetadata.WorkingDir,
+		Env:       createLrpEnv(mergeDockerImageEnv(executionMetadata.Env, desiredApp.Environment), primaryPort),
 		LogSource: AppLogSource,
 		ResourceLimits: &models.ResourceLimits{
 			Nofile: &numFiles,
@@ -156,7 +246,7 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 				"-inheritDaemonEnv",
 				"-logLevel=fatal",
 			},
-			Env: createLrpEnv(desiredApp.Environment, desiredAppPorts[0]),
+			Env: createLrpEnv(desiredApp.Environment, primaryPort),
 			ResourceLimits: &models.ResourceLimits{
 				Nofile: &numFiles,
 			},
@@ -176,6 +266,13 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 		sshRouteMessage := json.RawMessage(sshRoutePayload)
 		desiredAppRoutingInfo[ssh_routes.DIEGO_SSH] = &sshRouteMessage
 		desiredAppPorts = append(desiredAppPorts, DefaultSSHPort)
+		desiredAppPortMappings = append(desiredAppPortMappings, &models.PortMapping{Port: DefaultSSHPort, Protocol: "tcp"})
+	}
+
+	annotation, err := buildAnnotation(desiredApp.ETag, executionMetadata.Labels)
+	if err != nil {
+		buildLogger.Error("marshaling-image-labels-failed", err)
+		return nil, err
 	}
 
 	setupAction := models.Serial(setup...)
@@ -189,14 +286,15 @@ func (b *DockerRecipeBuilder) Build(desiredApp *cc_messages.DesireAppRequestFrom
 		ProcessGuid: lrpGuid,
 		Instances:   int32(desiredApp.NumInstances),
 		Routes:      &desiredAppRoutingInfo,
-		Annotation:  desiredApp.ETag,
+		Annotation:  annotation,
 
 		CpuWeight: cpuWeight(desiredApp.MemoryMB),
 
 		MemoryMb: int32(desiredApp.MemoryMB),
 		DiskMb:   int32(desiredApp.DiskMB),
 
-		Ports: desiredAppPorts,
+		Ports:        desiredAppPorts,
+		PortMappings: desiredAppPortMappings,
 
 		RootFs: rootFSPath,
 
@@ -222,32 +320,156 @@ func (b DockerRecipeBuilder) ExtractExposedPorts(desiredApp *cc_messages.DesireA
 	if err != nil {
 		return nil, err
 	}
-	return extractExposedPorts(metadata, b.logger)
+	ports, _, err := extractExposedPorts(metadata, desiredApp.Ports, b.logger)
+	return ports, err
 }
 
-func extractExposedPorts(executionMetadata DockerExecutionMetadata, logger lager.Logger) ([]uint32, error) {
-	var exposedPort uint32 = DefaultPort
+// extractExposedPorts derives the routable TCP ports and the full
+// port/protocol mapping (TCP and UDP) from the image's exposed ports.
+// requestedPorts, when non-empty, whitelists which of the image's exposed
+// ports are honored, mirroring `docker run -p`.
+func extractExposedPorts(executionMetadata DockerExecutionMetadata, requestedPorts []uint32, logger lager.Logger) ([]uint32, []*models.PortMapping, error) {
 	exposedPorts := executionMetadata.ExposedPorts
-	ports := make([]uint32, 0)
+
+	tcpPorts := make([]uint32, 0)
+	portMappings := make([]*models.PortMapping, 0)
+
 	if len(exposedPorts) == 0 {
-		ports = append(ports, exposedPort)
+		tcpPorts = append(tcpPorts, DefaultPort)
+		portMappings = append(portMappings, &models.PortMapping{Port: DefaultPort, Protocol: "tcp"})
 	}
+
 	for _, port := range exposedPorts {
-		if port.Protocol == "tcp" {
-			exposedPort = port.Port
-			ports = append(ports, exposedPort)
+		switch port.Protocol {
+		case "tcp":
+			tcpPorts = append(tcpPorts, port.Port)
+			portMappings = append(portMappings, &models.PortMapping{Port: port.Port, Protocol: "tcp"})
+		case "udp":
+			portMappings = append(portMappings, &models.PortMapping{Port: port.Port, Protocol: "udp"})
 		}
 	}
 
-	if len(ports) == 0 {
-		err := fmt.Errorf("No tcp ports found in image metadata")
+	if len(requestedPorts) > 0 {
+		tcpPorts = filterRequestedPorts(tcpPorts, requestedPorts)
+		portMappings = filterRequestedPortMappings(portMappings, requestedPorts)
+	}
+
+	if len(portMappings) == 0 {
+		err := fmt.Errorf("No exposed ports found in image metadata")
 		logger.Error("parsing-exposed-ports-failed", err, lager.Data{
 			"desired-app-metadata": executionMetadata,
 		})
+		return nil, nil, err
+	}
+
+	return tcpPorts, portMappings, nil
+}
+
+// filterRequestedPorts restricts exposedPorts to those the CC request
+// explicitly whitelisted.
+func filterRequestedPorts(exposedPorts []uint32, requestedPorts []uint32) []uint32 {
+	allowed := make(map[uint32]struct{}, len(requestedPorts))
+	for _, port := range requestedPorts {
+		allowed[port] = struct{}{}
+	}
+
+	filtered := make([]uint32, 0, len(exposedPorts))
+	for _, port := range exposedPorts {
+		if _, ok := allowed[port]; ok {
+			filtered = append(filtered, port)
+		}
+	}
+
+	return filtered
+}
+
+// filterRequestedPortMappings is filterRequestedPorts for the combined
+// TCP/UDP port mapping list.
+func filterRequestedPortMappings(portMappings []*models.PortMapping, requestedPorts []uint32) []*models.PortMapping {
+	allowed := make(map[uint32]struct{}, len(requestedPorts))
+	for _, port := range requestedPorts {
+		allowed[port] = struct{}{}
+	}
+
+	filtered := make([]*models.PortMapping, 0, len(portMappings))
+	for _, portMapping := range portMappings {
+		if _, ok := allowed[portMapping.Port]; ok {
+			filtered = append(filtered, portMapping)
+		}
+	}
+
+	return filtered
+}
+
+// hasUDPPortMapping reports whether any of the image's exposed ports are
+// UDP, used to distinguish "no ports at all" from "UDP-only" when deciding
+// whether skipping the liveness Monitor action was a deliberate choice.
+func hasUDPPortMapping(portMappings []*models.PortMapping) bool {
+	for _, portMapping := range portMappings {
+		if portMapping.Protocol == "udp" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasImageHealthcheck reports whether the image config carried a
+// HEALTHCHECK directive worth honoring. A Test of exactly ["NONE"] is
+// Docker's own idiom for disabling a base image's HEALTHCHECK and must be
+// treated the same as no healthcheck being declared at all, so that the
+// caller falls back to the port probe instead of erroring out.
+func hasImageHealthcheck(executionMetadata DockerExecutionMetadata) bool {
+	test := executionMetadata.Healthcheck.Test
+	return len(test) > 0 && !(len(test) == 1 && test[0] == "NONE")
+}
+
+// dockerHealthCheckMonitor translates the image's HEALTHCHECK Test into the
+// RunAction Diego already knows how to execute as the Monitor action,
+// preserving CMD/CMD-SHELL semantics from the Dockerfile.
+func dockerHealthCheckMonitor(executionMetadata DockerExecutionMetadata, user string) (models.ActionInterface, error) {
+	healthcheck := executionMetadata.Healthcheck
+
+	args, err := dockerHealthCheckArgs(healthcheck.Test)
+	if err != nil {
 		return nil, err
 	}
 
-	return ports, nil
+	timeout := healthcheck.Timeout
+	if timeout == 0 {
+		timeout = DefaultHealthCheckTimeout
+	}
+
+	return models.Timeout(&models.RunAction{
+		User:      user,
+		Path:      args[0],
+		Args:      args[1:],
+		LogSource: HealthLogSource,
+	}, timeout), nil
+}
+
+// dockerHealthCheckArgs translates a Docker HEALTHCHECK Test array (e.g.
+// ["CMD-SHELL", "curl -f http://localhost/ || exit 1"]) into an argv to run
+// as the extracted image user.
+func dockerHealthCheckArgs(test []string) ([]string, error) {
+	if len(test) == 0 {
+		return nil, ErrNoHealthCheckDefined
+	}
+
+	switch test[0] {
+	case "CMD":
+		if len(test) < 2 {
+			return nil, ErrInvalidHealthCheck
+		}
+		return test[1:], nil
+	case "CMD-SHELL":
+		if len(test) != 2 {
+			return nil, ErrInvalidHealthCheck
+		}
+		return []string{"/bin/sh", "-c", test[1]}, nil
+	default:
+		return nil, ErrInvalidHealthCheck
+	}
 }
 
 func extractUser(executionMetadata DockerExecutionMetadata) (string, error) {
@@ -258,25 +480,50 @@ func extractUser(executionMetadata DockerExecutionMetadata) (string, error) {
 	}
 }
 
-func convertDockerURI(dockerURI string) (string, error) {
+func convertDockerURI(dockerURI string, loginServer string) (string, error) {
 	if strings.Contains(dockerURI, "://") {
 		return "", errors.New("docker URI [" + dockerURI + "] should not contain scheme")
 	}
 
-	indexName, remoteName, tag := parseDockerRepoUrl(dockerURI)
+	indexName, remoteName, tag, digest, err := parseDockerRepoUrl(dockerURI, loginServer)
+	if err != nil {
+		return "", err
+	}
+
+	fragment := tag
+	if digest != "" {
+		// Preserve the pinned digest alongside the tag (tag may be empty)
+		// so the RootFs fetcher can verify content addressability.
+		fragment = tag + "@" + digest
+	}
 
 	return (&url.URL{
 		Scheme:   DockerScheme,
 		Path:     indexName + "/" + remoteName,
-		Fragment: tag,
+		Fragment: fragment,
 	}).String(), nil
 }
 
 // via https://github.com/docker/docker/blob/a271eaeba224652e3a12af0287afbae6f82a9333/registry/config.go#L295
-func parseDockerRepoUrl(dockerURI string) (indexName, remoteName, tag string) {
+//
+// loginServer, when set, is also how a private registry whose hostname has
+// no dot or port is disambiguated from a bare Docker Hub namespace (see
+// officialRegistry) — the CC is expected to pass DockerLoginServer for such
+// images rather than relying on the URI alone.
+func parseDockerRepoUrl(dockerURI string, loginServer string) (indexName, remoteName, tag, digest string, err error) {
 	nameParts := strings.SplitN(dockerURI, "/", 2)
 
-	if officialRegistry(nameParts) {
+	if loginServer != "" {
+		// The CC told us exactly which registry this image's credentials
+		// belong to; honor that instead of guessing from the URI.
+		prefix := loginServer + "/"
+		if !strings.HasPrefix(dockerURI, prefix) {
+			return "", "", "", "", ErrDockerImageLoginServerMismatch
+		}
+
+		indexName = loginServer
+		remoteName = strings.TrimPrefix(dockerURI, prefix)
+	} else if officialRegistry(nameParts) {
 		// URI without host
 		indexName = ""
 		remoteName = dockerURI
@@ -297,11 +544,155 @@ func parseDockerRepoUrl(dockerURI string) (indexName, remoteName, tag string) {
 		remoteName = nameParts[1]
 	}
 
-	remoteName, tag = parseDockerRepositoryTag(remoteName)
+	remoteName, tag, digest, err = parseDockerRepositoryTag(remoteName)
+	if err != nil {
+		return "", "", "", "", err
+	}
 
-	return indexName, remoteName, tag
+	return indexName, remoteName, tag, digest, nil
 }
 
+// dockerCredentialEnvVars surfaces private registry credentials to the
+// docker lifecycle as container environment variables, so the launcher can
+// authenticate the RootFs pull without the credentials ever being baked
+// into the RootFs URL itself. A registry may be authenticated with a
+// DockerUser/DockerPassword pair, a DockerRegistryToken, or both.
+func dockerCredentialEnvVars(desiredApp *cc_messages.DesireAppRequestFromCC) []*models.EnvironmentVariable {
+	if desiredApp.DockerUser == "" && desiredApp.DockerRegistryToken == "" {
+		return nil
+	}
+
+	envVars := []*models.EnvironmentVariable{
+		{Name: DockerLoginServerEnvVar, Value: desiredApp.DockerLoginServer},
+	}
+
+	if desiredApp.DockerUser != "" {
+		envVars = append(envVars,
+			&models.EnvironmentVariable{Name: DockerUserEnvVar, Value: desiredApp.DockerUser},
+			&models.EnvironmentVariable{Name: DockerPasswordEnvVar, Value: desiredApp.DockerPassword},
+		)
+
+		if desiredApp.DockerEmail != "" {
+			envVars = append(envVars, &models.EnvironmentVariable{Name: DockerEmailEnvVar, Value: desiredApp.DockerEmail})
+		}
+	}
+
+	if desiredApp.DockerRegistryToken != "" {
+		envVars = append(envVars, &models.EnvironmentVariable{Name: DockerRegistryTokenEnvVar, Value: desiredApp.DockerRegistryToken})
+	}
+
+	return envVars
+}
+
+// shellQuoteJoin joins args into a single string suitable for a shell to
+// re-split back into the original elements, single-quoting each one so
+// embedded spaces or shell metacharacters don't get reinterpreted.
+func shellQuoteJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+	}
+	return strings.Join(quoted, " ")
+}
+
+// mergeDockerImageEnv merges the image's own Env (as "KEY=VALUE" pairs
+// straight out of the Docker image config) with the user-supplied
+// desiredApp.Environment, with the user's values winning on conflict.
+// Declaration order is preserved: image-only vars first, followed by
+// user-only vars, in the order each was first seen.
+func mergeDockerImageEnv(imageEnv []string, userEnv []*models.EnvironmentVariable) []*models.EnvironmentVariable {
+	values := make(map[string]string, len(imageEnv)+len(userEnv))
+	order := make([]string, 0, len(imageEnv)+len(userEnv))
+
+	for _, kv := range imageEnv {
+		name := kv
+		value := ""
+		if idx := strings.Index(kv, "="); idx >= 0 {
+			name = kv[:idx]
+			value = kv[idx+1:]
+		}
+
+		if _, ok := values[name]; !ok {
+			order = append(order, name)
+		}
+		values[name] = value
+	}
+
+	for _, env := range userEnv {
+		if _, ok := values[env.Name]; !ok {
+			order = append(order, env.Name)
+		}
+		values[env.Name] = env.Value
+	}
+
+	merged := make([]*models.EnvironmentVariable, 0, len(order))
+	for _, name := range order {
+		merged = append(merged, &models.EnvironmentVariable{Name: name, Value: values[name]})
+	}
+
+	return merged
+}
+
+// dockerImageAnnotation is the JSON payload stashed in DesiredLRP.Annotation
+// so the CC-supplied ETag and the image's own Labels can both ride along
+// without requiring a dedicated bbs field for either.
+type dockerImageAnnotation struct {
+	ETag   string            `json:"etag,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// buildAnnotation folds the image's Labels into the DesiredLRP annotation
+// alongside the existing ETag. When the image declares no Labels, the
+// annotation is left as the bare ETag to avoid disturbing existing
+// consumers that compare it directly.
+func buildAnnotation(etag string, labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		return etag, nil
+	}
+
+	payload, err := json.Marshal(dockerImageAnnotation{ETag: etag, Labels: labels})
+	if err != nil {
+		return "", err
+	}
+
+	return string(payload), nil
+}
+
+// redactDockerCredentials returns desiredApp with the registry password and
+// registry token scrubbed, so it is safe to attach to lager.Data without
+// leaking secrets into the logs. When either is set the scrubbing is done on
+// a shallow copy, leaving desiredApp untouched; otherwise desiredApp itself
+// is returned.
+func redactDockerCredentials(desiredApp *cc_messages.DesireAppRequestFromCC) *cc_messages.DesireAppRequestFromCC {
+	if desiredApp.DockerPassword == "" && desiredApp.DockerRegistryToken == "" {
+		return desiredApp
+	}
+
+	redacted := *desiredApp
+	if redacted.DockerPassword != "" {
+		redacted.DockerPassword = "REDACTED"
+	}
+	if redacted.DockerRegistryToken != "" {
+		redacted.DockerRegistryToken = "REDACTED"
+	}
+	return &redacted
+}
+
+// officialRegistry reports whether a docker URI refers to the Docker Hub
+// index: either it has no host segment at all, its first path segment being
+// the first segment of a Docker Hub repository path (e.g. "library/ubuntu"
+// or "some-org/some-app"), or its first segment is the well-known index
+// DockerIndexServer itself. Any other first segment that looks like a
+// hostname (contains a dot, as in "ghcr.io" or "registry.local"; carries an
+// explicit port, as in "registry.local:5000"; or is "localhost") names a
+// different registry, and false is returned.
+//
+// A private registry hostname with neither a dot nor a port (e.g. an
+// internal DNS name like "myregistry") is syntactically indistinguishable
+// from a Docker Hub namespace like "someorg" and is classified as the
+// latter here, matching Docker's own distribution reference grammar. Such
+// registries must be referenced via the explicit DockerLoginServer request
+// field (see parseDockerRepoUrl), not by relying on this heuristic.
 func officialRegistry(nameParts []string) bool {
 	return len(nameParts) == 1 ||
 		nameParts[0] == DockerIndexServer ||
@@ -310,14 +701,34 @@ func officialRegistry(nameParts []string) bool {
 			nameParts[0] != "localhost")
 }
 
+// digestPattern matches an opencontainers-style "algo:hex" digest for the
+// algorithms Docker's registry actually produces: sha256 (64 hex chars),
+// sha384 (96), and sha512 (128).
+var digestPattern = regexp.MustCompile(`^(sha256:[0-9a-f]{64}|sha384:[0-9a-f]{96}|sha512:[0-9a-f]{128})$`)
+
 // via https://github.com/docker/docker/blob/4398108/pkg/parsers/parsers.go#L72
-func parseDockerRepositoryTag(remoteName string) (string, string) {
+//
+// Extended to accept a trailing "@sha256:<hex>" digest, alone or combined
+// with a tag (e.g. "repo:tag@sha256:<hex>"), so deployments can pin to an
+// immutable content-addressable image. The digest is validated against
+// digestPattern so a malformed pin fails fast here rather than at RootFs
+// fetch time.
+func parseDockerRepositoryTag(remoteName string) (name, tag, digest string, err error) {
+	if at := strings.Index(remoteName, "@"); at >= 0 {
+		digest = remoteName[at+1:]
+		remoteName = remoteName[:at]
+
+		if !digestPattern.MatchString(digest) {
+			return "", "", "", ErrInvalidDockerDigest
+		}
+	}
+
 	n := strings.LastIndex(remoteName, ":")
 	if n < 0 {
-		return remoteName, ""
+		return remoteName, "", digest, nil
 	}
 	if tag := remoteName[n+1:]; !strings.Contains(tag, "/") {
-		return remoteName[:n], tag
+		return remoteName[:n], tag, digest, nil
 	}
-	return remoteName, ""
+	return remoteName, "", digest, nil
 }
@@ -0,0 +1,581 @@
+package recipebuilder
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/cloudfoundry-incubator/bbs/models"
+	sshkeys "github.com/cloudfoundry-incubator/diego-ssh/keys"
+	"github.com/cloudfoundry-incubator/runtime-schema/cc_messages"
+	"github.com/pivotal-golang/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeKeyPair is a minimal stand-in for the diego-ssh KeyPair the real
+// KeyFactory produces. It wraps a real ssh.Signer so it satisfies
+// sshkeys.KeyPair in full, rather than mocking the signer/public-key
+// methods Build doesn't inspect.
+type fakeKeyPair struct {
+	tag    string
+	signer ssh.Signer
+}
+
+func newFakeKeyPair(tag string) fakeKeyPair {
+	key, err := rsa.GenerateKey(rand.Reader, 512)
+	if err != nil {
+		panic(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		panic(err)
+	}
+	return fakeKeyPair{tag: tag, signer: signer}
+}
+
+func (k fakeKeyPair) PrivateKey() ssh.Signer       { return k.signer }
+func (k fakeKeyPair) PEMEncodedPrivateKey() string { return "pem-" + k.tag }
+func (k fakeKeyPair) PublicKey() ssh.PublicKey     { return k.signer.PublicKey() }
+func (k fakeKeyPair) Fingerprint() string          { return "fingerprint-" + k.tag }
+func (k fakeKeyPair) AuthorizedKey() string        { return "authorized-" + k.tag }
+
+// fakeKeyPairFactory hands out distinguishable fakeKeyPairs so Build's
+// separate host/user key pairs can be told apart in assertions.
+type fakeKeyPairFactory struct {
+	generated int
+}
+
+func (f *fakeKeyPairFactory) NewKeyPair(bits int) (sshkeys.KeyPair, error) {
+	f.generated++
+	return newFakeKeyPair(fmt.Sprintf("%d", f.generated)), nil
+}
+
+func testBuilderConfig() Config {
+	return Config{
+		Lifecycles:    map[string]string{"docker": "docker_lifecycle/docker_app_lifecycle.tgz"},
+		FileServerURL: "http://file-server.service.cf.internal",
+		KeyFactory:    &fakeKeyPairFactory{},
+	}
+}
+
+func TestDockerCredentialEnvVars(t *testing.T) {
+	cases := []struct {
+		name string
+		app  *cc_messages.DesireAppRequestFromCC
+		want []*models.EnvironmentVariable
+	}{
+		{
+			name: "anonymous public image has no credential env vars",
+			app:  &cc_messages.DesireAppRequestFromCC{},
+			want: nil,
+		},
+		{
+			name: "user/password private registry",
+			app: &cc_messages.DesireAppRequestFromCC{
+				DockerLoginServer: "docker-registry.example.com",
+				DockerUser:        "someuser",
+				DockerPassword:    "somepassword",
+			},
+			want: []*models.EnvironmentVariable{
+				{Name: DockerLoginServerEnvVar, Value: "docker-registry.example.com"},
+				{Name: DockerUserEnvVar, Value: "someuser"},
+				{Name: DockerPasswordEnvVar, Value: "somepassword"},
+			},
+		},
+		{
+			name: "user/password with email",
+			app: &cc_messages.DesireAppRequestFromCC{
+				DockerLoginServer: "docker-registry.example.com",
+				DockerUser:        "someuser",
+				DockerPassword:    "somepassword",
+				DockerEmail:       "someuser@example.com",
+			},
+			want: []*models.EnvironmentVariable{
+				{Name: DockerLoginServerEnvVar, Value: "docker-registry.example.com"},
+				{Name: DockerUserEnvVar, Value: "someuser"},
+				{Name: DockerPasswordEnvVar, Value: "somepassword"},
+				{Name: DockerEmailEnvVar, Value: "someuser@example.com"},
+			},
+		},
+		{
+			name: "registry token auth only",
+			app: &cc_messages.DesireAppRequestFromCC{
+				DockerLoginServer:   "docker-registry.example.com",
+				DockerRegistryToken: "some-token",
+			},
+			want: []*models.EnvironmentVariable{
+				{Name: DockerLoginServerEnvVar, Value: "docker-registry.example.com"},
+				{Name: DockerRegistryTokenEnvVar, Value: "some-token"},
+			},
+		},
+		{
+			name: "user/password and registry token combined",
+			app: &cc_messages.DesireAppRequestFromCC{
+				DockerLoginServer:   "docker-registry.example.com",
+				DockerUser:          "someuser",
+				DockerPassword:      "somepassword",
+				DockerRegistryToken: "some-token",
+			},
+			want: []*models.EnvironmentVariable{
+				{Name: DockerLoginServerEnvVar, Value: "docker-registry.example.com"},
+				{Name: DockerUserEnvVar, Value: "someuser"},
+				{Name: DockerPasswordEnvVar, Value: "somepassword"},
+				{Name: DockerRegistryTokenEnvVar, Value: "some-token"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := dockerCredentialEnvVars(tc.app)
+
+			if len(got) != len(tc.want) {
+				t.Fatalf("dockerCredentialEnvVars() = %+v, want %+v", got, tc.want)
+			}
+
+			for i := range got {
+				if *got[i] != *tc.want[i] {
+					t.Errorf("dockerCredentialEnvVars()[%d] = %+v, want %+v", i, *got[i], *tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestDockerCredentialEnvVarsMixedPublicAndPrivate exercises a single CC
+// producing both a public (anonymous) and a private (authenticated) docker
+// app back to back, guarding against credential state leaking between
+// DesireAppRequestFromCC values built from the same CC payload.
+func TestDockerCredentialEnvVarsMixedPublicAndPrivate(t *testing.T) {
+	publicApp := &cc_messages.DesireAppRequestFromCC{DockerImageUrl: "ubuntu"}
+	privateApp := &cc_messages.DesireAppRequestFromCC{
+		DockerImageUrl:    "docker-registry.example.com/someuser/privateapp",
+		DockerLoginServer: "docker-registry.example.com",
+		DockerUser:        "someuser",
+		DockerPassword:    "somepassword",
+	}
+
+	if got := dockerCredentialEnvVars(publicApp); got != nil {
+		t.Errorf("dockerCredentialEnvVars(public) = %+v, want nil", got)
+	}
+
+	if got := dockerCredentialEnvVars(privateApp); len(got) != 3 {
+		t.Errorf("dockerCredentialEnvVars(private) = %+v, want 3 entries", got)
+	}
+}
+
+func TestRedactDockerCredentials(t *testing.T) {
+	app := &cc_messages.DesireAppRequestFromCC{
+		DockerPassword:      "somepassword",
+		DockerRegistryToken: "some-token",
+	}
+
+	redacted := redactDockerCredentials(app)
+
+	if redacted.DockerPassword != "REDACTED" {
+		t.Errorf("redacted.DockerPassword = %q, want REDACTED", redacted.DockerPassword)
+	}
+	if redacted.DockerRegistryToken != "REDACTED" {
+		t.Errorf("redacted.DockerRegistryToken = %q, want REDACTED", redacted.DockerRegistryToken)
+	}
+	if app.DockerPassword != "somepassword" {
+		t.Errorf("original app.DockerPassword was mutated: %q", app.DockerPassword)
+	}
+}
+
+func TestParseDockerRepoUrl(t *testing.T) {
+	cases := []struct {
+		name           string
+		dockerURI      string
+		loginServer    string
+		wantIndexName  string
+		wantRemoteName string
+		wantTag        string
+		wantDigest     string
+	}{
+		{
+			name:           "bare image name defaults to docker hub library namespace",
+			dockerURI:      "ubuntu",
+			wantIndexName:  "",
+			wantRemoteName: "library/ubuntu",
+		},
+		{
+			name:           "docker hub org/repo with no host segment",
+			dockerURI:      "someorg/somerepo:sometag",
+			wantIndexName:  "",
+			wantRemoteName: "someorg/somerepo",
+			wantTag:        "sometag",
+		},
+		{
+			name:           "explicit docker.io host",
+			dockerURI:      "docker.io/library/ubuntu:14.04",
+			wantIndexName:  "docker.io",
+			wantRemoteName: "library/ubuntu",
+			wantTag:        "14.04",
+		},
+		{
+			name:           "OCI registry host with dot",
+			dockerURI:      "ghcr.io/someorg/somerepo:sometag",
+			wantIndexName:  "ghcr.io",
+			wantRemoteName: "someorg/somerepo",
+			wantTag:        "sometag",
+		},
+		{
+			name:           "private registry host with explicit port",
+			dockerURI:      "registry.local:5000/somerepo",
+			wantIndexName:  "registry.local:5000",
+			wantRemoteName: "somerepo",
+		},
+		{
+			name:           "digest only, no tag",
+			dockerURI:      "someorg/somerepo@sha256:" + sha256HexFixture,
+			wantIndexName:  "",
+			wantRemoteName: "someorg/somerepo",
+			wantDigest:     "sha256:" + sha256HexFixture,
+		},
+		{
+			name:           "tag and digest combined",
+			dockerURI:      "someorg/somerepo:sometag@sha256:" + sha256HexFixture,
+			wantIndexName:  "",
+			wantRemoteName: "someorg/somerepo",
+			wantTag:        "sometag",
+			wantDigest:     "sha256:" + sha256HexFixture,
+		},
+		{
+			name:           "bare dotless private registry disambiguated via DockerLoginServer",
+			dockerURI:      "myregistry/myrepo:sometag",
+			loginServer:    "myregistry",
+			wantIndexName:  "myregistry",
+			wantRemoteName: "myrepo",
+			wantTag:        "sometag",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			indexName, remoteName, tag, digest, err := parseDockerRepoUrl(tc.dockerURI, tc.loginServer)
+			if err != nil {
+				t.Fatalf("parseDockerRepoUrl(%q, %q) err = %v, want nil", tc.dockerURI, tc.loginServer, err)
+			}
+
+			if indexName != tc.wantIndexName || remoteName != tc.wantRemoteName || tag != tc.wantTag || digest != tc.wantDigest {
+				t.Errorf("parseDockerRepoUrl(%q, %q) = (%q, %q, %q, %q), want (%q, %q, %q, %q)",
+					tc.dockerURI, tc.loginServer,
+					indexName, remoteName, tag, digest,
+					tc.wantIndexName, tc.wantRemoteName, tc.wantTag, tc.wantDigest)
+			}
+		})
+	}
+}
+
+// sha256HexFixture is a syntactically valid (if meaningless) sha256 hex
+// digest body, used anywhere a test needs a digest that passes
+// digestPattern without asserting anything about its specific value.
+const sha256HexFixture = "abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234abcd1234"
+
+func TestConvertDockerURIPinnedDigest(t *testing.T) {
+	rootFS, err := convertDockerURI("someorg/somerepo:sometag@sha256:"+sha256HexFixture, "")
+	if err != nil {
+		t.Fatalf("convertDockerURI() err = %v, want nil", err)
+	}
+
+	want := "docker:///someorg/somerepo#sometag@sha256:" + sha256HexFixture
+	if rootFS != want {
+		t.Errorf("convertDockerURI() = %q, want %q", rootFS, want)
+	}
+}
+
+func TestParseDockerRepositoryTagInvalidDigest(t *testing.T) {
+	cases := []struct {
+		name       string
+		remoteName string
+	}{
+		{"too short to be sha256", "somerepo@sha256:abcd1234"},
+		{"unrecognized algorithm", "somerepo@md5:" + sha256HexFixture},
+		{"non-hex characters", "somerepo@sha256:" + strings.Repeat("g", 64)},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, _, _, err := parseDockerRepositoryTag(tc.remoteName)
+			if err != ErrInvalidDockerDigest {
+				t.Errorf("parseDockerRepositoryTag(%q) err = %v, want %v", tc.remoteName, err, ErrInvalidDockerDigest)
+			}
+		})
+	}
+}
+
+func TestParseDockerRepoUrlInvalidDigest(t *testing.T) {
+	_, _, _, _, err := parseDockerRepoUrl("someorg/somerepo@sha256:abcd1234", "")
+	if err != ErrInvalidDockerDigest {
+		t.Errorf("parseDockerRepoUrl() err = %v, want %v", err, ErrInvalidDockerDigest)
+	}
+}
+
+func TestParseDockerRepoUrlLoginServerMismatch(t *testing.T) {
+	_, _, _, _, err := parseDockerRepoUrl("otherhost/myrepo", "myregistry")
+	if err != ErrDockerImageLoginServerMismatch {
+		t.Errorf("parseDockerRepoUrl() err = %v, want %v", err, ErrDockerImageLoginServerMismatch)
+	}
+}
+
+func TestParseDockerRepoUrlLoginServerDisambiguatesBareHost(t *testing.T) {
+	indexName, remoteName, tag, _, err := parseDockerRepoUrl("myregistry/myrepo:latest", "myregistry")
+	if err != nil {
+		t.Fatalf("parseDockerRepoUrl() err = %v, want nil", err)
+	}
+	if indexName != "myregistry" || remoteName != "myrepo" || tag != "latest" {
+		t.Errorf("parseDockerRepoUrl() = (%q, %q, %q), want (myregistry, myrepo, latest)", indexName, remoteName, tag)
+	}
+}
+
+func TestHasUDPPortMapping(t *testing.T) {
+	cases := []struct {
+		name         string
+		portMappings []*models.PortMapping
+		want         bool
+	}{
+		{"no ports", nil, false},
+		{"tcp only", []*models.PortMapping{{Port: 8080, Protocol: "tcp"}}, false},
+		{"udp only", []*models.PortMapping{{Port: 53, Protocol: "udp"}}, true},
+		{"mixed tcp and udp", []*models.PortMapping{{Port: 8080, Protocol: "tcp"}, {Port: 53, Protocol: "udp"}}, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := hasUDPPortMapping(tc.portMappings); got != tc.want {
+				t.Errorf("hasUDPPortMapping(%+v) = %v, want %v", tc.portMappings, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestExtractExposedPortsUDPOnly(t *testing.T) {
+	metadata := DockerExecutionMetadata{
+		ExposedPorts: []DockerPort{
+			{Port: 53, Protocol: "udp"},
+		},
+	}
+
+	tcpPorts, portMappings, err := extractExposedPorts(metadata, nil, lager.NewLogger("recipebuilder-test"))
+	if err != nil {
+		t.Fatalf("extractExposedPorts() err = %v, want nil", err)
+	}
+
+	if len(tcpPorts) != 0 {
+		t.Errorf("extractExposedPorts() tcpPorts = %+v, want empty", tcpPorts)
+	}
+
+	if !hasUDPPortMapping(portMappings) {
+		t.Errorf("extractExposedPorts() portMappings = %+v, want a udp entry", portMappings)
+	}
+}
+
+func TestHasImageHealthcheck(t *testing.T) {
+	cases := []struct {
+		name string
+		test []string
+		want bool
+	}{
+		{"no test defined", nil, false},
+		{"empty test slice", []string{}, false},
+		{"explicit NONE disables healthcheck", []string{"NONE"}, false},
+		{"CMD healthcheck present", []string{"CMD", "curl", "-f", "http://localhost"}, true},
+		{"CMD-SHELL healthcheck present", []string{"CMD-SHELL", "curl -f http://localhost || exit 1"}, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			metadata := DockerExecutionMetadata{
+				Healthcheck: DockerImageHealthcheck{Test: tc.test},
+			}
+
+			if got := hasImageHealthcheck(metadata); got != tc.want {
+				t.Errorf("hasImageHealthcheck(%v) = %v, want %v", tc.test, got, tc.want)
+			}
+		})
+	}
+}
+
+func baseDesiredApp() *cc_messages.DesireAppRequestFromCC {
+	return &cc_messages.DesireAppRequestFromCC{
+		ProcessGuid:    "process-guid",
+		DockerImageUrl: "ubuntu",
+		NumInstances:   1,
+		LogGuid:        "log-guid",
+	}
+}
+
+func TestBuildHealthCheckAndPortCombinations(t *testing.T) {
+	builder := NewDockerRecipeBuilder(lager.NewLogger("recipebuilder-test"), testBuilderConfig())
+
+	t.Run("unspecified health check probes the default exposed port", func(t *testing.T) {
+		desiredApp := baseDesiredApp()
+
+		lrp, err := builder.Build(desiredApp)
+		if err != nil {
+			t.Fatalf("Build() err = %v, want nil", err)
+		}
+
+		if lrp.Monitor == nil {
+			t.Error("Monitor = nil, want a port-probe monitor action")
+		}
+		if len(lrp.Ports) != 1 || lrp.Ports[0] != DefaultPort {
+			t.Errorf("Ports = %+v, want [%d]", lrp.Ports, DefaultPort)
+		}
+		if len(lrp.PortMappings) != 1 || lrp.PortMappings[0].Port != DefaultPort || lrp.PortMappings[0].Protocol != "tcp" {
+			t.Errorf("PortMappings = %+v, want a single tcp entry for port %d", lrp.PortMappings, DefaultPort)
+		}
+	})
+
+	t.Run("explicit port health check type probes the default exposed port", func(t *testing.T) {
+		desiredApp := baseDesiredApp()
+		desiredApp.HealthCheckType = cc_messages.PortHealthCheckType
+
+		lrp, err := builder.Build(desiredApp)
+		if err != nil {
+			t.Fatalf("Build() err = %v, want nil", err)
+		}
+		if lrp.Monitor == nil {
+			t.Error("Monitor = nil, want a port-probe monitor action")
+		}
+	})
+
+	t.Run("docker health check type with no image healthcheck fails fast", func(t *testing.T) {
+		desiredApp := baseDesiredApp()
+		desiredApp.HealthCheckType = cc_messages.DockerHealthCheckType
+
+		_, err := builder.Build(desiredApp)
+		if err != ErrNoHealthCheckDefined {
+			t.Errorf("Build() err = %v, want %v", err, ErrNoHealthCheckDefined)
+		}
+	})
+
+	t.Run("AllowSSH appends the ssh port to both Ports and PortMappings", func(t *testing.T) {
+		desiredApp := baseDesiredApp()
+		desiredApp.AllowSSH = true
+
+		lrp, err := builder.Build(desiredApp)
+		if err != nil {
+			t.Fatalf("Build() err = %v, want nil", err)
+		}
+
+		if len(lrp.Ports) != 2 || lrp.Ports[0] != DefaultPort || lrp.Ports[1] != DefaultSSHPort {
+			t.Errorf("Ports = %+v, want [%d, %d]", lrp.Ports, DefaultPort, DefaultSSHPort)
+		}
+
+		foundSSHPortMapping := false
+		for _, portMapping := range lrp.PortMappings {
+			if portMapping.Port == DefaultSSHPort && portMapping.Protocol == "tcp" {
+				foundSSHPortMapping = true
+			}
+		}
+		if !foundSSHPortMapping {
+			t.Errorf("PortMappings = %+v, want an entry for the ssh port %d", lrp.PortMappings, DefaultSSHPort)
+		}
+	})
+}
+
+func TestMergeDockerImageEnv(t *testing.T) {
+	cases := []struct {
+		name     string
+		imageEnv []string
+		userEnv  []*models.EnvironmentVariable
+		want     []*models.EnvironmentVariable
+	}{
+		{
+			name:     "image env only, order preserved",
+			imageEnv: []string{"PATH=/usr/bin", "HOME=/root"},
+			want: []*models.EnvironmentVariable{
+				{Name: "PATH", Value: "/usr/bin"},
+				{Name: "HOME", Value: "/root"},
+			},
+		},
+		{
+			name:     "user env appended after image-only vars",
+			imageEnv: []string{"PATH=/usr/bin"},
+			userEnv:  []*models.EnvironmentVariable{{Name: "FOO", Value: "bar"}},
+			want: []*models.EnvironmentVariable{
+				{Name: "PATH", Value: "/usr/bin"},
+				{Name: "FOO", Value: "bar"},
+			},
+		},
+		{
+			name:     "user env wins on conflict but keeps image's position",
+			imageEnv: []string{"PATH=/usr/bin", "FOO=image-value"},
+			userEnv:  []*models.EnvironmentVariable{{Name: "FOO", Value: "user-value"}},
+			want: []*models.EnvironmentVariable{
+				{Name: "PATH", Value: "/usr/bin"},
+				{Name: "FOO", Value: "user-value"},
+			},
+		},
+		{
+			name:     "malformed image env with no '=' is treated as a bare name with an empty value",
+			imageEnv: []string{"NOEQUALSIGN"},
+			want: []*models.EnvironmentVariable{
+				{Name: "NOEQUALSIGN", Value: ""},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := mergeDockerImageEnv(tc.imageEnv, tc.userEnv)
+			if len(got) != len(tc.want) {
+				t.Fatalf("mergeDockerImageEnv() = %+v, want %+v", got, tc.want)
+			}
+			for i := range got {
+				if got[i].Name != tc.want[i].Name || got[i].Value != tc.want[i].Value {
+					t.Errorf("mergeDockerImageEnv()[%d] = %+v, want %+v", i, got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBuildAnnotation(t *testing.T) {
+	t.Run("no labels passes the etag through unchanged", func(t *testing.T) {
+		annotation, err := buildAnnotation("etag-123", nil)
+		if err != nil {
+			t.Fatalf("buildAnnotation() err = %v, want nil", err)
+		}
+		if annotation != "etag-123" {
+			t.Errorf("buildAnnotation() = %q, want %q", annotation, "etag-123")
+		}
+	})
+
+	t.Run("labels produce a JSON envelope carrying the etag", func(t *testing.T) {
+		annotation, err := buildAnnotation("etag-123", map[string]string{"version": "1.0"})
+		if err != nil {
+			t.Fatalf("buildAnnotation() err = %v, want nil", err)
+		}
+
+		want := `{"etag":"etag-123","labels":{"version":"1.0"}}`
+		if annotation != want {
+			t.Errorf("buildAnnotation() = %q, want %q", annotation, want)
+		}
+	})
+}
+
+func TestShellQuoteJoin(t *testing.T) {
+	cases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"no args", nil, ""},
+		{"single simple arg", []string{"/bin/run"}, `'/bin/run'`},
+		{"arg with a space preserves its boundary", []string{"/bin/run", "hello world"}, `'/bin/run' 'hello world'`},
+		{"embedded single quote is escaped", []string{"it's"}, `'it'\''s'`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := shellQuoteJoin(tc.args); got != tc.want {
+				t.Errorf("shellQuoteJoin(%q) = %q, want %q", tc.args, got, tc.want)
+			}
+		})
+	}
+}